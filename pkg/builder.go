@@ -1,12 +1,15 @@
 package avp
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"sync"
 
+	avpcodecs "github.com/carrotsong/ion-avp/pkg/codecs"
 	"github.com/carrotsong/ion-avp/pkg/log"
+	"github.com/carrotsong/ion-avp/pkg/queue"
 	"github.com/carrotsong/rtp"
 	"github.com/carrotsong/rtp/codecs"
 	"github.com/carrotsong/webrtc/v3"
@@ -15,47 +18,158 @@ import (
 
 const (
 	maxSize = 100
+
+	// queueCapacity is the number of samples retained per track in the
+	// PacketQueue, enough to cover a few seconds at typical video/audio
+	// sample rates so late-joining elements can seek back.
+	queueCapacity = 300
+)
+
+// queuedSample is the internal unit pushed through Builder.out: the sample
+// itself plus whether it is safe to resume decoding from, used to populate
+// the PacketQueue's keyframe Timeline. Only H264 samples are inspected for
+// this; every sample of any other codec is marked as a keyframe.
+type queuedSample struct {
+	sample   *Sample
+	keyframe bool
+}
+
+// annexBStartCode is the Annex-B NAL unit start code emitted by the pion H264
+// depacketizer ahead of every NAL unit.
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+const (
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeIDR = 5
 )
 
 var (
 	// ErrCodecNotSupported is returned when a rtp packed it pushed with an unsupported codec
 	ErrCodecNotSupported = errors.New("codec not supported")
+
+	// ErrPayloadTypeNotNegotiated is returned when a packet's payload type
+	// does not match any codec the Builder was configured with.
+	ErrPayloadTypeNotNegotiated = errors.New("payload type not negotiated")
 )
 
+// codecEntry bundles everything the Builder needs to depacketize and gate a
+// single negotiated RTP payload type.
+type codecEntry struct {
+	capability   webrtc.RTPCodecCapability
+	depacketizer rtp.Depacketizer
+	checker      rtp.PartitionHeadChecker
+	isH264       bool
+}
+
+// depacketizerFor returns the depacketizer, partition head checker and H264
+// flag for a codec name, mirroring the set of codecs NewBuilder has always
+// supported.
+func depacketizerFor(name string) (rtp.Depacketizer, rtp.PartitionHeadChecker, bool) {
+	switch name {
+	case webrtc.Opus:
+		return &codecs.OpusPacket{}, &codecs.OpusPartitionHeadChecker{}, false
+	case webrtc.VP8:
+		return &codecs.VP8Packet{}, &codecs.VP8PartitionHeadChecker{}, false
+	case webrtc.VP9:
+		return &codecs.VP9Packet{}, &codecs.VP9PartitionHeadChecker{}, false
+	case webrtc.H264:
+		return &codecs.H264Packet{}, &avpcodecs.H264PartitionHeadChecker{}, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// Option configures optional Builder behavior.
+type Option func(*Builder)
+
+// WithKeyframeOnly configures the Builder to only forward H264 samples that
+// are anchored on an IDR NAL unit, dropping delta frames in between. This is
+// useful for elements that only care about periodic keyframes (e.g. thumbnail
+// generation) rather than a full decodable stream.
+func WithKeyframeOnly(keyframeOnly bool) Option {
+	return func(b *Builder) {
+		b.keyframeOnly = keyframeOnly
+	}
+}
+
+// WithRTPCodecs configures the set of codecs the SFU has negotiated for this
+// track, keyed by RTP payload type. When set, the Builder watches incoming
+// packets for a payload type change (e.g. a simulcast layer switch or a
+// mid-session re-offer) and reinitializes its sample builder for the new
+// codec instead of continuing to depacketize with the stale one.
+//
+// Builder has no source for this list on its own — it only ever sees the
+// single *webrtc.Track it was constructed with — so the caller minting the
+// Builder (Transport.NewBuilder, wherever tracks are added to a session)
+// must pass the SFU's negotiated webrtc.RTPCodecParameters for this option
+// to do anything; without it codecsByPT stays empty and build() never
+// attempts a payload-type switch.
+func WithRTPCodecs(params []webrtc.RTPCodecParameters) Option {
+	return func(b *Builder) {
+		for _, p := range params {
+			depacketizer, checker, isH264 := depacketizerFor(p.Name)
+			if depacketizer == nil {
+				continue
+			}
+			b.codecsByPT[uint8(p.PayloadType)] = &codecEntry{
+				capability: webrtc.RTPCodecCapability{
+					Name:      p.Name,
+					ClockRate: p.ClockRate,
+				},
+				depacketizer: depacketizer,
+				checker:      checker,
+				isH264:       isH264,
+			}
+		}
+	}
+}
+
 // Builder Module for building video/audio samples from rtp streams
 type Builder struct {
 	mu            sync.RWMutex
 	stopped       bool
 	onStopHandler func()
 	builder       *samplebuilder.SampleBuilder
+	maxLate       uint16
 	elements      []Element
+	workers       []*elementWorker
 	sequence      uint16
 	track         *webrtc.Track
-	out           chan *Sample
+	out           chan queuedSample
+	queue         *queue.PacketQueue
+
+	isH264       bool
+	keyframeOnly bool
+	gotKeyframe  bool
+	sps          []byte
+	pps          []byte
+
+	codecsByPT    map[uint8]*codecEntry
+	currentPT     uint8
+	currentCodec  webrtc.RTPCodecCapability
+	onCodecChange func(old, new webrtc.RTPCodecCapability)
+	onError       func(error)
 }
 
 // NewBuilder Initialize a new audio sample builder
-func NewBuilder(track *webrtc.Track, maxLate uint16) *Builder {
-	var depacketizer rtp.Depacketizer
-	var checker rtp.PartitionHeadChecker
-	switch track.Codec().Name {
-	case webrtc.Opus:
-		depacketizer = &codecs.OpusPacket{}
-		checker = &codecs.OpusPartitionHeadChecker{}
-	case webrtc.VP8:
-		depacketizer = &codecs.VP8Packet{}
-		checker = &codecs.VP8PartitionHeadChecker{}
-	case webrtc.VP9:
-		depacketizer = &codecs.VP9Packet{}
-		checker = &codecs.VP9PartitionHeadChecker{}
-	case webrtc.H264:
-		depacketizer = &codecs.H264Packet{}
-	}
+func NewBuilder(track *webrtc.Track, maxLate uint16, options ...Option) *Builder {
+	depacketizer, checker, isH264 := depacketizerFor(track.Codec().Name)
 
 	b := &Builder{
-		builder: samplebuilder.New(maxLate, depacketizer),
-		track:   track,
-		out:     make(chan *Sample, maxSize),
+		builder:      samplebuilder.New(maxLate, depacketizer),
+		maxLate:      maxLate,
+		track:        track,
+		out:          make(chan queuedSample, maxSize),
+		queue:        queue.New(queueCapacity),
+		isH264:       isH264,
+		currentPT:    uint8(track.PayloadType()),
+		currentCodec: track.Codec().RTPCodecCapability,
+		codecsByPT:   make(map[uint8]*codecEntry),
+	}
+
+	for _, o := range options {
+		o(b)
 	}
 
 	if checker != nil {
@@ -68,14 +182,121 @@ func NewBuilder(track *webrtc.Track, maxLate uint16) *Builder {
 	return b
 }
 
-// AttachElement attaches a element to a builder
-func (b *Builder) AttachElement(e Element) {
+// SPS returns the most recently seen H264 sequence parameter set, in Annex-B
+// form (without the start code). It is nil for non-H264 tracks or before the
+// first SPS has been observed. webrtc.Track has no field of its own for
+// codec-private data, so this (and PPS) is exposed here, alongside Track(),
+// as the metadata a muxer needs when writing a track's init segment.
+func (b *Builder) SPS() []byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.sps
+}
+
+// PPS returns the most recently seen H264 picture parameter set, in Annex-B
+// form (without the start code). It is nil for non-H264 tracks or before the
+// first PPS has been observed. See SPS for why this lives here rather than
+// on webrtc.Track itself.
+func (b *Builder) PPS() []byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.pps
+}
+
+// AttachOption configures how an Element attached via AttachElement joins
+// the track and reacts to falling behind.
+type AttachOption func(*attachConfig)
+
+type attachConfig struct {
+	seek          queue.SeekMode
+	queuePolicy   queue.BackpressurePolicy
+	elementPolicy ElementPolicy
+	queueSize     int
+}
+
+// WithSeek controls where in the track's retained history a newly attached
+// Element starts reading from. Defaults to queue.SeekLatest.
+func WithSeek(mode queue.SeekMode) AttachOption {
+	return func(c *attachConfig) {
+		c.seek = mode
+	}
+}
+
+// WithBackpressure controls what happens when an Element's cursor falls
+// behind the PacketQueue's retention window. Defaults to
+// queue.DropNonKeyframe.
+func WithBackpressure(policy queue.BackpressurePolicy) AttachOption {
+	return func(c *attachConfig) {
+		c.queuePolicy = policy
+	}
+}
+
+// WithElementPolicy controls what happens when an Element's own write queue
+// fills up because Element.Write can't keep up with the cursor. Defaults to
+// ElementDropNonKey.
+func WithElementPolicy(policy ElementPolicy) AttachOption {
+	return func(c *attachConfig) {
+		c.elementPolicy = policy
+	}
+}
+
+// WithElementQueueSize overrides the default depth of an Element's bounded
+// write queue.
+func WithElementQueueSize(size int) AttachOption {
+	return func(c *attachConfig) {
+		c.queueSize = size
+	}
+}
+
+// AttachElement attaches a element to a builder. The element is wrapped in
+// an elementWorker with its own bounded queue and goroutine, fed by a cursor
+// reading the track's PacketQueue on yet another goroutine. This means a
+// slow Element only ever blocks itself: it can't stall the PacketQueue for
+// other Elements, and a full queue is handled per the configured
+// ElementPolicy instead of backing up the whole pipeline.
+func (b *Builder) AttachElement(e Element, opts ...AttachOption) {
+	cfg := attachConfig{
+		seek:          queue.SeekLatest,
+		queuePolicy:   queue.DropNonKeyframe,
+		elementPolicy: ElementDropNonKey,
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	worker := newElementWorker(e, cfg.elementPolicy, cfg.queueSize)
+
 	b.mu.Lock()
-	defer b.mu.Unlock()
 	b.elements = append(b.elements, e)
+	b.workers = append(b.workers, worker)
+	q := b.queue
+	b.mu.Unlock()
+
+	cursor := q.NewCursor(cfg.seek)
+	go readElement(cursor, cfg.queuePolicy, worker)
 }
 
-// Track returns the builders underlying track
+// readElement drains a single Element's cursor into its elementWorker until
+// the track's queue is closed.
+func readElement(cursor *queue.Cursor, policy queue.BackpressurePolicy, worker *elementWorker) {
+	for {
+		entry, err := cursor.Read(policy)
+		if err != nil {
+			worker.close()
+			return
+		}
+		sample, ok := entry.Value.(*Sample)
+		if !ok {
+			continue
+		}
+		worker.enqueue(sample, entry.Keyframe)
+	}
+}
+
+// Track returns the builder's underlying track. webrtc.Track has no field
+// of its own for codec-private data, so it carries no SPS/PPS; a muxer
+// needing those should call SPS()/PPS() on this Builder alongside Track(),
+// not look for them on the track itself.
 func (b *Builder) Track() *webrtc.Track {
 	return b.track
 }
@@ -87,6 +308,71 @@ func (b *Builder) OnStop(f func()) {
 	b.onStopHandler = f
 }
 
+// OnCodecChange is called whenever the Builder detects that the negotiated
+// codec for this track's SSRC has changed, e.g. because the SFU renegotiated
+// the payload type mid-stream. It fires after the Builder has already
+// reinitialized its sample builder for the new codec.
+func (b *Builder) OnCodecChange(f func(old, new webrtc.RTPCodecCapability)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onCodecChange = f
+}
+
+// OnError is called whenever build() rejects an incoming RTP packet instead
+// of pushing it to the sample builder, e.g. a malformed packet ReadRTP
+// itself refused to parse (too short or otherwise) or
+// ErrPayloadTypeNotNegotiated. The packet is always dropped regardless of
+// whether a handler is set; this only gives a caller a way to observe why.
+func (b *Builder) OnError(f func(error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onError = f
+}
+
+// switchCodec reinitializes the sample builder for a newly observed payload
+// type, popping and discarding any samples still pending in the old one
+// (they are not forwarded downstream). It must be called with
+// b.mu held.
+func (b *Builder) switchCodec(pt uint8, entry *codecEntry) {
+	old := b.currentCodec
+
+	for {
+		sample, _ := b.builder.PopWithTimestamp()
+		if sample == nil {
+			break
+		}
+	}
+
+	b.builder = samplebuilder.New(b.maxLate, entry.depacketizer)
+	if entry.checker != nil {
+		samplebuilder.WithPartitionHeadChecker(entry.checker)(b.builder)
+	}
+
+	b.currentPT = pt
+	b.currentCodec = entry.capability
+	b.isH264 = entry.isH264
+	b.gotKeyframe = false
+	b.sps = nil
+	b.pps = nil
+
+	if b.onCodecChange != nil {
+		b.onCodecChange(old, entry.capability)
+	}
+}
+
+// reportError logs a rejected RTP packet and, if set, notifies the OnError
+// handler. The packet itself is always dropped by the caller; this only
+// surfaces why.
+func (b *Builder) reportError(err error) {
+	log.Errorf("Error reading track rtp %s", err)
+	b.mu.RLock()
+	handler := b.onError
+	b.mu.RUnlock()
+	if handler != nil {
+		handler(err)
+	}
+}
+
 func (b *Builder) build() {
 	log.Debugf("Reading rtp for track: %s", b.Track().ID())
 	for {
@@ -103,10 +389,26 @@ func (b *Builder) build() {
 				b.stop()
 				return
 			}
-			log.Errorf("Error reading track rtp %s", err)
+			// ReadRTP already rejects anything shorter than a valid RTP
+			// header before it ever gets here, so this is the branch a
+			// too-short (or otherwise malformed) packet actually surfaces
+			// through; route it through reportError so OnError sees it.
+			b.reportError(err)
 			continue
 		}
 
+		b.mu.Lock()
+		if len(b.codecsByPT) > 0 && pkt.PayloadType != b.currentPT {
+			entry, ok := b.codecsByPT[pkt.PayloadType]
+			if !ok {
+				b.mu.Unlock()
+				b.reportError(ErrPayloadTypeNotNegotiated)
+				continue
+			}
+			b.switchCodec(pkt.PayloadType, entry)
+		}
+		b.mu.Unlock()
+
 		b.builder.Push(pkt)
 
 		for {
@@ -125,37 +427,136 @@ func (b *Builder) build() {
 				break
 			}
 
-			b.out <- &Sample{
-				Type:           int(b.track.Codec().Type),
-				SequenceNumber: b.sequence,
-				Timestamp:      timestamp,
-				Payload:        sample.Data,
-				TrackID:        b.track.ID(),
+			payload := sample.Data
+			keyframe := true
+			if b.isH264 {
+				var ok bool
+				payload, ok, keyframe = b.gateH264(payload)
+				if !ok {
+					continue
+				}
+			}
+
+			b.out <- queuedSample{
+				sample: &Sample{
+					Type:           int(b.track.Codec().Type),
+					SequenceNumber: b.sequence,
+					Timestamp:      timestamp,
+					Payload:        payload,
+					TrackID:        b.track.ID(),
+				},
+				keyframe: keyframe,
 			}
 			b.sequence++
 		}
 	}
 }
 
-// Read sample
-func (b *Builder) forward() {
-	for {
-		sample := <-b.out
+// gateH264 inspects an Annex-B H264 sample, tracking the latest SPS/PPS and
+// deciding whether the sample should be forwarded. It returns the (possibly
+// rewritten) payload and whether it should be emitted. The first sample ever
+// emitted for the track is held back until an IDR arrives so every track
+// starts on a keyframe; every IDR-bearing sample after that, not just the
+// first, is also prefixed with the last-seen SPS/PPS, since a late-joining
+// Element seeked via queue.SeekLastKeyframe can land on any of them and
+// needs a decodable Annex-B stream on its own, not just the very first GOP.
+// When keyframeOnly is set, non-IDR delta frames are dropped as well.
+func (b *Builder) gateH264(payload []byte) ([]byte, bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-		b.mu.RLock()
-		elements := b.elements
-		if b.stopped {
-			b.mu.RUnlock()
-			return
+	hasIDR, hasSPS, hasPPS := false, false, false
+	for _, nalu := range splitAnnexB(payload) {
+		if len(nalu) == 0 {
+			continue
 		}
-		for _, e := range elements {
-			err := e.Write(sample)
-			if err != nil {
-				log.Errorf("error writing sample: %s", err)
-			}
+		switch nalu[0] & 0x1F {
+		case naluTypeSPS:
+			b.sps = nalu
+			hasSPS = true
+		case naluTypePPS:
+			b.pps = nalu
+			hasPPS = true
+		case naluTypeIDR:
+			hasIDR = true
 		}
-		b.mu.RUnlock()
 	}
+
+	if !b.gotKeyframe {
+		if !hasIDR {
+			return nil, false, false
+		}
+		b.gotKeyframe = true
+		return b.prependParamSets(payload, hasSPS, hasPPS), true, true
+	}
+
+	if b.keyframeOnly && !hasIDR {
+		return nil, false, false
+	}
+
+	if hasIDR {
+		return b.prependParamSets(payload, hasSPS, hasPPS), true, true
+	}
+
+	return payload, true, false
+}
+
+// prependParamSets prefixes payload with the last-seen SPS/PPS, skipping
+// whichever of the two this particular sample already carries in-band, so a
+// decoder starting decode from this sample has what it needs without
+// duplicating parameter sets the encoder already repeated itself.
+func (b *Builder) prependParamSets(payload []byte, hasSPS, hasPPS bool) []byte {
+	needSPS := b.sps != nil && !hasSPS
+	needPPS := b.pps != nil && !hasPPS
+	if !needSPS && !needPPS {
+		return payload
+	}
+
+	var buf bytes.Buffer
+	if needSPS {
+		buf.Write(annexBStartCode)
+		buf.Write(b.sps)
+	}
+	if needPPS {
+		buf.Write(annexBStartCode)
+		buf.Write(b.pps)
+	}
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// splitAnnexB splits an Annex-B byte stream into its constituent NAL units,
+// stripping start codes.
+func splitAnnexB(stream []byte) [][]byte {
+	var naluses [][]byte
+	for len(stream) > 0 {
+		idx := bytes.Index(stream, annexBStartCode)
+		if idx != 0 {
+			break
+		}
+		stream = stream[len(annexBStartCode):]
+		next := bytes.Index(stream, annexBStartCode)
+		if next == -1 {
+			naluses = append(naluses, stream)
+			break
+		}
+		naluses = append(naluses, stream[:next])
+		stream = stream[next:]
+	}
+	return naluses
+}
+
+// forward drains newly built samples into the track's PacketQueue, where
+// each attached Element's own cursor picks them up independently.
+func (b *Builder) forward() {
+	for qs := range b.out {
+		b.queue.Push(queue.Entry{
+			PTS:      qs.sample.Timestamp,
+			Keyframe: qs.keyframe,
+			Value:    qs.sample,
+		})
+	}
+	b.queue.Close()
 }
 
 // Stop stop all buffer
@@ -166,8 +567,8 @@ func (b *Builder) stop() {
 		return
 	}
 	b.stopped = true
-	for _, e := range b.elements {
-		e.Close()
+	for _, w := range b.workers {
+		w.close()
 	}
 	if b.onStopHandler != nil {
 		b.onStopHandler()
@@ -179,8 +580,8 @@ func (b *Builder) stats() string {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	info := fmt.Sprintf("      track: %s\n", b.track.ID())
-	for _, e := range b.elements {
-		info += fmt.Sprintf("        element: %T\n", e)
+	for _, w := range b.workers {
+		info += w.stat()
 	}
 	return info
 }
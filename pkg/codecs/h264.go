@@ -0,0 +1,56 @@
+package codecs
+
+const (
+	naluTypeSPS = 7
+	naluTypePPS = 8
+	naluTypeIDR = 5
+
+	fuaNALUType   = 28
+	stapaNALUType = 24
+)
+
+// H264PartitionHeadChecker checks H264 packet to determine if it is the head
+// of a new partition (access unit). SPS, PPS and IDR slices are treated as
+// partition heads so the sample builder starts a new sample on NAL units that
+// downstream muxers care about.
+type H264PartitionHeadChecker struct{}
+
+// IsPartitionHead checks whether if this is a head of the H264 partition
+func (*H264PartitionHeadChecker) IsPartitionHead(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	naluType := payload[0] & 0x1F
+	switch naluType {
+	case stapaNALUType:
+		// STAP-A aggregates multiple NAL units; the first one starts at
+		// offset 3 (1 byte STAP-A header + 2 byte NALU size).
+		if len(payload) < 4 {
+			return false
+		}
+		return isKeyNALUType(payload[3] & 0x1F)
+	case fuaNALUType:
+		// FU-A fragment: only the fragment carrying the start bit (S) marks
+		// the beginning of the fragmented NAL unit.
+		if len(payload) < 2 {
+			return false
+		}
+		s := payload[1]&0x80 != 0
+		if !s {
+			return false
+		}
+		return isKeyNALUType(payload[1] & 0x1F)
+	default:
+		return isKeyNALUType(naluType)
+	}
+}
+
+func isKeyNALUType(naluType byte) bool {
+	switch naluType {
+	case naluTypeSPS, naluTypePPS, naluTypeIDR:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,178 @@
+package avp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/carrotsong/ion-avp/pkg/log"
+)
+
+// defaultWorkerQueueSize is the default depth of an elementWorker's bounded
+// channel, chosen to absorb a couple of GOPs worth of 1080p frames without
+// growing unbounded.
+const defaultWorkerQueueSize = 256
+
+// ElementPolicy controls what an elementWorker does when its bounded queue
+// is full and a new sample is ready to be written.
+type ElementPolicy int
+
+const (
+	// ElementDrop drops the incoming sample, keeping everything already
+	// queued.
+	ElementDrop ElementPolicy = iota
+	// ElementDropNonKey drops the incoming sample unless it is a keyframe,
+	// in which case it drops the oldest queued sample to make room. This
+	// keeps a video element from being stuck behind a long run of frames it
+	// can no longer use without a keyframe to resync on.
+	ElementDropNonKey
+	// ElementBlock blocks the caller until the worker has room, exerting
+	// backpressure up through the cursor read loop.
+	ElementBlock
+	// ElementClose closes the Element and stops its worker the first time
+	// its queue fills, for elements that would rather stop than ever skip
+	// or reorder a sample.
+	ElementClose
+)
+
+// workerItem is a queued sample plus whether it is a keyframe, so
+// ElementDropNonKey can make an eviction decision without re-inspecting the
+// sample payload.
+type workerItem struct {
+	sample   *Sample
+	keyframe bool
+}
+
+// elementWorkerStats holds the Prometheus-style counters exposed for a
+// single attached Element via Builder.stats().
+type elementWorkerStats struct {
+	written     uint64
+	dropped     uint64
+	lastLatency int64 // time.Duration, stored atomically
+}
+
+// elementWorker owns the bounded channel and dedicated goroutine for a
+// single Element, so a slow Write on one Element can never block samples
+// reaching any other Element attached to the same Builder.
+//
+// w.ch is never closed: closing it would race enqueue()'s sends against
+// close() with nothing to order them, which panics if a send is selected
+// after the close. Shutdown instead happens via done, which both enqueue
+// and run select on, so neither blocks on ch once done is closed; a select
+// that finds both ch and done ready may still pick ch.
+type elementWorker struct {
+	element Element
+	policy  ElementPolicy
+	ch      chan workerItem
+	done    chan struct{}
+	mu      sync.Mutex // serializes ElementDropNonKey's evict-then-send step
+	closed  int32
+	stats   elementWorkerStats
+}
+
+func newElementWorker(e Element, policy ElementPolicy, queueSize int) *elementWorker {
+	if queueSize <= 0 {
+		queueSize = defaultWorkerQueueSize
+	}
+	w := &elementWorker{
+		element: e,
+		policy:  policy,
+		ch:      make(chan workerItem, queueSize),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue offers a sample to the worker, applying its configured policy if
+// the bounded channel is already full. It never blocks unless the policy is
+// ElementBlock. Every send on w.ch is paired with a select on w.done so a
+// concurrent close() can never race it.
+func (w *elementWorker) enqueue(sample *Sample, keyframe bool) {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	item := workerItem{sample: sample, keyframe: keyframe}
+
+	if w.policy == ElementBlock {
+		select {
+		case w.ch <- item:
+		case <-w.done:
+		}
+		return
+	}
+
+	select {
+	case w.ch <- item:
+		return
+	case <-w.done:
+		return
+	default:
+	}
+
+	switch w.policy {
+	case ElementDropNonKey:
+		if !keyframe {
+			atomic.AddUint64(&w.stats.dropped, 1)
+			return
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		select {
+		case <-w.ch:
+			atomic.AddUint64(&w.stats.dropped, 1)
+		default:
+		}
+		select {
+		case w.ch <- item:
+		case <-w.done:
+		default:
+			atomic.AddUint64(&w.stats.dropped, 1)
+		}
+	case ElementClose:
+		w.close()
+	default: // ElementDrop
+		atomic.AddUint64(&w.stats.dropped, 1)
+	}
+}
+
+func (w *elementWorker) run() {
+	for {
+		select {
+		case item := <-w.ch:
+			start := time.Now()
+			if err := w.element.Write(item.sample); err != nil {
+				log.Errorf("error writing sample: %s", err)
+			}
+			atomic.AddUint64(&w.stats.written, 1)
+			atomic.StoreInt64(&w.stats.lastLatency, int64(time.Since(start)))
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// close stops the worker's goroutine and the underlying Element. Safe to
+// call more than once.
+func (w *elementWorker) close() {
+	if !atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		return
+	}
+	close(w.done)
+	w.element.Close()
+}
+
+func (w *elementWorker) stat() string {
+	return fmt.Sprintf(
+		"        element: %T written: %d dropped: %d queue_depth: %d last_write_latency: %s\n",
+		w.element,
+		atomic.LoadUint64(&w.stats.written),
+		atomic.LoadUint64(&w.stats.dropped),
+		len(w.ch),
+		time.Duration(atomic.LoadInt64(&w.stats.lastLatency)),
+	)
+}
@@ -0,0 +1,200 @@
+// Package queue implements a ring-buffered packet queue and keyframe
+// timeline sitting between a Builder and its attached Elements, so a slow
+// element no longer blocks the others and a newly attached element can
+// join mid-session instead of only at the next keyframe it happens to see.
+package queue
+
+import (
+	"errors"
+	"sync"
+)
+
+// BackpressurePolicy controls what PacketQueue does when a reader cursor
+// falls behind the ring and the sample it's about to read has already been
+// overwritten.
+type BackpressurePolicy int
+
+const (
+	// DropOldest silently advances the cursor to the oldest sample still in
+	// the ring, dropping everything the reader missed.
+	DropOldest BackpressurePolicy = iota
+	// DropNonKeyframe advances the cursor to the nearest keyframe at or
+	// after the oldest sample still in the ring, so the reader never starts
+	// decoding mid-GOP.
+	DropNonKeyframe
+	// Block makes Read wait until the requested entry is written. Push never
+	// waits for readers, so a Block cursor that has fallen behind the ring is
+	// moved to the oldest retained entry, exactly as with DropOldest.
+	Block
+)
+
+// ErrClosed is returned by Read once the queue has been closed and drained.
+var ErrClosed = errors.New("packet queue closed")
+
+// Entry is a single item held in the ring, carrying its presentation
+// timestamp; the ring itself is indexed by push order. Value is opaque to the queue (typically a *avp.Sample) so this
+// package has no dependency on what it's carrying.
+type Entry struct {
+	PTS      uint32
+	Keyframe bool
+	Value    interface{}
+}
+
+// Cursor is a per-reader position into a PacketQueue.
+type Cursor struct {
+	q    *PacketQueue
+	next uint64
+}
+
+// PacketQueue is a fixed-capacity ring buffer of Entry holding the last N
+// entries written for a single track, along with a Timeline of keyframe
+// offsets so readers can seek back to the last keyframe or to a timestamp.
+type PacketQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	entries  []Entry
+	written  []uint64 // absolute sequence number stored at ring index i
+	head     uint64   // absolute sequence number of the next write
+	closed   bool
+	timeline *Timeline
+}
+
+// New creates a PacketQueue holding up to capacity entries.
+func New(capacity int) *PacketQueue {
+	q := &PacketQueue{
+		entries:  make([]Entry, capacity),
+		written:  make([]uint64, capacity),
+		timeline: newTimeline(capacity),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	for i := range q.written {
+		q.written[i] = ^uint64(0) // sentinel: slot never written
+	}
+	return q
+}
+
+// Push appends an entry to the ring, overwriting the oldest entry once the
+// queue is at capacity, and records it in the Timeline if it is a keyframe.
+func (q *PacketQueue) Push(e Entry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+
+	idx := int(q.head % uint64(len(q.entries)))
+	q.entries[idx] = e
+	q.written[idx] = q.head
+	if e.Keyframe {
+		q.timeline.mark(q.head, e.PTS)
+	}
+	q.head++
+	q.cond.Broadcast()
+}
+
+// Close unblocks any readers waiting on this queue and marks it closed.
+func (q *PacketQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// NewCursor returns a Cursor positioned according to from.
+func (q *PacketQueue) NewCursor(from SeekMode) *Cursor {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c := &Cursor{q: q}
+	switch from {
+	case SeekLatest:
+		c.next = q.head
+	case SeekOldest:
+		c.next = q.oldestLocked()
+	case SeekLastKeyframe:
+		if seq, ok := q.timeline.lastKeyframe(); ok {
+			c.next = seq
+		} else {
+			c.next = q.oldestLocked()
+		}
+	}
+	return c
+}
+
+// NewCursorAt returns a Cursor seeked to the keyframe covering timestamp ts,
+// falling back to the oldest retained entry if ts predates the ring.
+func (q *PacketQueue) NewCursorAt(ts uint32) *Cursor {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c := &Cursor{q: q}
+	if seq, ok := q.timeline.keyframeBefore(ts); ok {
+		c.next = seq
+	} else {
+		c.next = q.oldestLocked()
+	}
+	return c
+}
+
+func (q *PacketQueue) oldestLocked() uint64 {
+	if q.head < uint64(len(q.entries)) {
+		return 0
+	}
+	return q.head - uint64(len(q.entries))
+}
+
+// Read blocks until the entry at the cursor's position is available, under
+// every policy, applies the backpressure policy if it has fallen off the
+// back of the ring, and advances the cursor.
+func (c *Cursor) Read(policy BackpressurePolicy) (Entry, error) {
+	q := c.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		oldest := q.oldestLocked()
+		if c.next < oldest {
+			switch policy {
+			case DropNonKeyframe:
+				if seq, ok := q.timeline.keyframeAtOrAfter(oldest); ok {
+					c.next = seq
+				} else {
+					c.next = oldest
+				}
+			default: // DropOldest and Block both just catch up to oldest
+				c.next = oldest
+			}
+		}
+
+		if c.next < q.head {
+			idx := int(c.next % uint64(len(q.entries)))
+			e := q.entries[idx]
+			c.next++
+			return e, nil
+		}
+
+		if q.closed {
+			return Entry{}, ErrClosed
+		}
+
+		if policy != Block {
+			q.cond.Wait()
+			continue
+		}
+		q.cond.Wait()
+	}
+}
+
+// SeekMode selects the starting position for a new Cursor.
+type SeekMode int
+
+const (
+	// SeekLatest starts the cursor at the next entry written after it is
+	// created, i.e. the normal real-time tail of the queue.
+	SeekLatest SeekMode = iota
+	// SeekOldest starts the cursor at the oldest entry still retained.
+	SeekOldest
+	// SeekLastKeyframe starts the cursor at the most recent keyframe, so a
+	// late-joining element gets a decodable stream immediately.
+	SeekLastKeyframe
+)
@@ -0,0 +1,75 @@
+package queue
+
+// Timeline indexes the sequence number and presentation timestamp of the
+// keyframes pushed to a PacketQueue, so a Cursor can seek back to "the last
+// keyframe" or "the keyframe covering timestamp T" by a linear scan of the
+// keyframes alone instead of every entry in the ring. Old keyframes are
+// pruned only when a new one is marked, so the index can still hold
+// keyframes the ring has since overwritten.
+type Timeline struct {
+	// keyframes is kept sorted by seq (and therefore by pts, since both are
+	// monotonically increasing as entries are pushed).
+	keyframes []keyframeRef
+	capacity  int
+}
+
+type keyframeRef struct {
+	seq uint64
+	pts uint32
+}
+
+func newTimeline(capacity int) *Timeline {
+	return &Timeline{capacity: capacity}
+}
+
+// mark records a keyframe at seq/pts, evicting entries older than what the
+// ring can still hold so the index never grows unbounded.
+func (t *Timeline) mark(seq uint64, pts uint32) {
+	t.keyframes = append(t.keyframes, keyframeRef{seq: seq, pts: pts})
+
+	oldest := uint64(0)
+	if seq >= uint64(t.capacity) {
+		oldest = seq - uint64(t.capacity) + 1
+	}
+	i := 0
+	for i < len(t.keyframes) && t.keyframes[i].seq < oldest {
+		i++
+	}
+	t.keyframes = t.keyframes[i:]
+}
+
+// lastKeyframe returns the sequence number of the most recently marked
+// keyframe still in the index.
+func (t *Timeline) lastKeyframe() (uint64, bool) {
+	if len(t.keyframes) == 0 {
+		return 0, false
+	}
+	return t.keyframes[len(t.keyframes)-1].seq, true
+}
+
+// keyframeBefore returns the sequence number of the latest keyframe whose
+// pts is <= ts.
+func (t *Timeline) keyframeBefore(ts uint32) (uint64, bool) {
+	found := false
+	var seq uint64
+	for _, k := range t.keyframes {
+		if k.pts <= ts {
+			seq = k.seq
+			found = true
+			continue
+		}
+		break
+	}
+	return seq, found
+}
+
+// keyframeAtOrAfter returns the sequence number of the earliest keyframe
+// whose seq is >= minSeq.
+func (t *Timeline) keyframeAtOrAfter(minSeq uint64) (uint64, bool) {
+	for _, k := range t.keyframes {
+		if k.seq >= minSeq {
+			return k.seq, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,517 @@
+package avp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carrotsong/ion-avp/pkg/log"
+	"github.com/carrotsong/rtp"
+	"github.com/carrotsong/webrtc/v3"
+)
+
+const (
+	rtspDialTimeout   = 5 * time.Second
+	rtspReconnectWait = 2 * time.Second
+)
+
+// rtspTrack describes one SETUP-able media stream announced in an RTSP
+// server's SDP, enough to mint a matching *webrtc.Track.
+type rtspTrack struct {
+	control     string
+	id          string
+	codec       string
+	payloadType uint8
+	clockRate   uint32
+	interleaved [2]int       // RTP/RTCP channel numbers for TCP interleaved mode
+	udpConn     *net.UDPConn // local RTP socket bound for UDP transport mode
+	serverPort  int          // server's RTP port, from the SETUP response Transport header
+}
+
+// RTSPSource pulls H264/Opus media from a plain RTSP camera (or a bare
+// rtp:// endpoint with no RTSP signalling at all) and feeds it into the same
+// Transport/Builder pipeline used for ion-sfu subscriptions, so recording,
+// transcoding and inference Elements don't need to know whether their media
+// came from an SFU or a camera.
+type RTSPSource struct {
+	mu             sync.Mutex
+	url            *url.URL
+	sid            string
+	config         Config
+	transport      *Transport
+	onCloseHandler func()
+	closed         bool
+	conn           net.Conn
+}
+
+// NewRTSPSource connects to a `rtsp://` or `rtp://` endpoint and starts
+// pumping incoming RTP into sid's Transport, reconnecting with a fixed
+// backoff until Close is called.
+func NewRTSPSource(rawurl, sid string, config Config) (*RTSPSource, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RTSPSource{
+		url:    u,
+		sid:    sid,
+		config: config,
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// GetTransport returns (creating if necessary) the Transport this source
+// feeds tracks into. RTSPSource only ever serves the single session id it
+// was created for.
+func (s *RTSPSource) GetTransport(sid string) *Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transport == nil {
+		s.transport = newTransport(sid, s.config)
+	}
+	return s.transport
+}
+
+// OnClose registers f to be called by Close, which also ends the reconnect
+// loop; a transient reconnect does not call it. f runs inside Close, before
+// the ingest loop has necessarily exited.
+func (s *RTSPSource) OnClose(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onCloseHandler = f
+}
+
+// Close stops the reconnect loop and tears down the current connection, if
+// any.
+func (s *RTSPSource) Close() {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	handler := s.onCloseHandler
+	s.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	if handler != nil {
+		handler()
+	}
+}
+
+func (s *RTSPSource) stats() string {
+	return fmt.Sprintf("      source: %s://%s%s\n", s.url.Scheme, s.url.Host, s.url.Path)
+}
+
+// run drives the connect/ingest loop, reconnecting with a fixed backoff
+// whenever the upstream connection drops, until Close is called.
+func (s *RTSPSource) run() {
+	for {
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+
+		var err error
+		switch s.url.Scheme {
+		case "rtsp":
+			err = s.ingestRTSP()
+		case "rtp":
+			err = s.ingestRawRTP()
+		default:
+			log.Errorf("rtsp source: unsupported scheme %q", s.url.Scheme)
+			return
+		}
+		if err != nil {
+			log.Errorf("rtsp source %s: %s", s.url.Host, err)
+		}
+
+		time.Sleep(rtspReconnectWait)
+	}
+}
+
+// ingestRTSP performs DESCRIBE/SETUP/PLAY against an RTSP server and pumps
+// the resulting RTP into the session Transport until the connection drops.
+func (s *RTSPSource) ingestRTSP() error {
+	conn, err := net.DialTimeout("tcp", s.url.Host, rtspDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	cseq := 1
+
+	tracks, err := s.describe(rw, &cseq)
+	if err != nil {
+		return err
+	}
+
+	wantsTCP := s.url.Query().Get("transport") != "udp"
+	for i := range tracks {
+		if err := s.setup(rw, &cseq, &tracks[i], i, wantsTCP); err != nil {
+			return err
+		}
+	}
+	if !wantsTCP {
+		defer func() {
+			for _, trk := range tracks {
+				if trk.udpConn != nil {
+					trk.udpConn.Close()
+				}
+			}
+		}()
+	}
+
+	if _, _, err := s.request(rw, &cseq, "PLAY", s.url.String(), nil); err != nil {
+		return err
+	}
+
+	t := s.GetTransport(s.sid)
+	wtracks := make(map[int]*webrtc.Track, len(tracks))
+	for i, trk := range tracks {
+		wt, err := webrtc.NewTrack(webrtc.PayloadType(trk.payloadType), newSSRC(), trk.id, s.sid, webrtc.RTPCodecCapability{
+			Name:      trk.codec,
+			ClockRate: trk.clockRate,
+		})
+		if err != nil {
+			return err
+		}
+		t.addTrack(wt)
+		if wantsTCP {
+			wtracks[trk.interleaved[0]] = wt
+		} else {
+			log.Debugf("rtsp source: track %s udp client_port=%d server_port=%d", trk.id, trk.udpConn.LocalAddr().(*net.UDPAddr).Port, trk.serverPort)
+			go func(id string, conn *net.UDPConn, wt *webrtc.Track) {
+				if err := pumpRawRTP(conn, wt); err != nil {
+					log.Errorf("rtsp source: udp track %s: %s", id, err)
+				}
+			}(trk.id, tracks[i].udpConn, wt)
+		}
+	}
+
+	if !wantsTCP {
+		// Media arrives on the per-track UDP sockets pumped above; this TCP
+		// connection now only carries signalling, so block on it until the
+		// server tears it down (or it errors out) to let run's reconnect
+		// loop notice the session ended.
+		return waitForTeardown(rw.Reader)
+	}
+
+	return pumpInterleavedRTP(rw.Reader, wtracks)
+}
+
+// waitForTeardown blocks until the RTSP control connection errors or is
+// closed, used to keep ingestRTSP alive (and its reconnect semantics
+// working) when media is flowing over separate UDP sockets rather than this
+// connection's interleaved channels.
+func waitForTeardown(r *bufio.Reader) error {
+	for {
+		if _, err := r.ReadByte(); err != nil {
+			return err
+		}
+	}
+}
+
+// ingestRawRTP skips RTSP signalling entirely and just listens for RTP on a
+// UDP socket, for cameras/encoders that push a raw stream with no session
+// setup at all. The payload type and codec are taken from the URL query
+// (e.g. rtp://0.0.0.0:5004?pt=96&codec=H264&clockrate=90000).
+func (s *RTSPSource) ingestRawRTP() error {
+	addr, err := net.ResolveUDPAddr("udp", s.url.Host)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	q := s.url.Query()
+	pt, _ := strconv.Atoi(q.Get("pt"))
+	clockRate, _ := strconv.Atoi(q.Get("clockrate"))
+	codec := q.Get("codec")
+	if codec == "" {
+		codec = webrtc.H264
+	}
+	for _, name := range []string{webrtc.H264, webrtc.Opus, webrtc.VP8, webrtc.VP9} {
+		if strings.EqualFold(codec, name) {
+			codec = name
+			break
+		}
+	}
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+
+	t := s.GetTransport(s.sid)
+	wt, err := webrtc.NewTrack(webrtc.PayloadType(pt), newSSRC(), "rtp", s.sid, webrtc.RTPCodecCapability{
+		Name:      codec,
+		ClockRate: uint32(clockRate),
+	})
+	if err != nil {
+		return err
+	}
+	t.addTrack(wt)
+
+	return pumpRawRTP(conn, wt)
+}
+
+// describe sends an RTSP DESCRIBE and parses the minimal set of SDP `m=`/
+// `a=control:` lines needed to SETUP each media stream.
+func (s *RTSPSource) describe(rw *bufio.ReadWriter, cseq *int) ([]rtspTrack, error) {
+	body, _, err := s.request(rw, cseq, "DESCRIBE", s.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+
+	var tracks []rtspTrack
+	var current *rtspTrack
+	for _, line := range strings.Split(body, "\r\n") {
+		switch {
+		case strings.HasPrefix(line, "m=audio"), strings.HasPrefix(line, "m=video"):
+			if current != nil {
+				tracks = append(tracks, *current)
+			}
+			fields := strings.Fields(line)
+			// clockRate falls back to the common default for the media type;
+			// a matching a=rtpmap below, if present, overrides it with the
+			// rate the server actually announced.
+			codec, clockRate := webrtc.Opus, uint32(48000)
+			if strings.HasPrefix(line, "m=video") {
+				codec, clockRate = webrtc.H264, 90000
+			}
+			current = &rtspTrack{id: fields[0][2:], codec: codec, clockRate: clockRate}
+			if len(fields) > 3 {
+				if pt, err := strconv.Atoi(fields[3]); err == nil {
+					current.payloadType = uint8(pt)
+				}
+			}
+		case strings.HasPrefix(line, "a=control:") && current != nil:
+			current.control = strings.TrimPrefix(line, "a=control:")
+		case strings.HasPrefix(line, "a=rtpmap:") && current != nil:
+			// a=rtpmap:<payload type> <encoding>/<clock rate>[/<channels>]
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+			if len(fields) != 2 {
+				continue
+			}
+			pt, err := strconv.Atoi(fields[0])
+			if err != nil || uint8(pt) != current.payloadType {
+				continue
+			}
+			encoding := strings.Split(fields[1], "/")
+			if len(encoding) < 2 {
+				continue
+			}
+			if clockRate, err := strconv.Atoi(encoding[1]); err == nil {
+				current.clockRate = uint32(clockRate)
+			}
+		}
+	}
+	if current != nil {
+		tracks = append(tracks, *current)
+	}
+
+	return tracks, nil
+}
+
+// setup sends an RTSP SETUP for a single track, requesting TCP interleaved
+// channels by default. For UDP it binds a local RTP socket first so the
+// client_port it advertises is one it's actually listening on, then records
+// the server's server_port from the response for diagnostics.
+func (s *RTSPSource) setup(rw *bufio.ReadWriter, cseq *int, trk *rtspTrack, index int, tcp bool) error {
+	uri := trk.control
+	if !strings.Contains(uri, "://") {
+		uri = strings.TrimRight(s.url.String(), "/") + "/" + uri
+	}
+
+	var transport string
+	if tcp {
+		trk.interleaved = [2]int{index * 2, index*2 + 1}
+		transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", trk.interleaved[0], trk.interleaved[1])
+	} else {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
+		if err != nil {
+			return err
+		}
+		trk.udpConn = conn
+		clientPort := conn.LocalAddr().(*net.UDPAddr).Port
+		transport = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", clientPort, clientPort+1)
+	}
+
+	_, respHeaders, err := s.request(rw, cseq, "SETUP", uri, map[string]string{"Transport": transport})
+	if err != nil {
+		return err
+	}
+
+	if !tcp {
+		if v, ok := transportParam(respHeaders["transport"], "server_port"); ok {
+			if port, _ := strconv.Atoi(strings.SplitN(v, "-", 2)[0]); port > 0 {
+				trk.serverPort = port
+			}
+		}
+	}
+
+	return nil
+}
+
+// transportParam extracts the value of a ";"-delimited key=value parameter
+// (e.g. server_port) from an RTSP Transport response header.
+func transportParam(transport, key string) (string, bool) {
+	for _, part := range strings.Split(transport, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			return kv[1], true
+		}
+	}
+	return "", false
+}
+
+// request writes a single RTSP request and returns the response body along
+// with its headers, keyed by lowercased header name, so callers that need
+// more than Content-Length (e.g. SETUP's Transport) don't have to reparse.
+func (s *RTSPSource) request(rw *bufio.ReadWriter, cseq *int, method, uri string, headers map[string]string) (string, map[string]string, error) {
+	fmt.Fprintf(rw, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(rw, "CSeq: %d\r\n", *cseq)
+	*cseq++
+	for k, v := range headers {
+		fmt.Fprintf(rw, "%s: %s\r\n", k, v)
+	}
+	fmt.Fprint(rw, "\r\n")
+	if err := rw.Flush(); err != nil {
+		return "", nil, err
+	}
+
+	status, err := rw.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	if !strings.Contains(status, "200") {
+		return "", nil, fmt.Errorf("rtsp %s failed: %s", method, strings.TrimSpace(status))
+	}
+
+	contentLength := 0
+	respHeaders := make(map[string]string)
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		respHeaders[name] = value
+		if name == "content-length" {
+			contentLength, _ = strconv.Atoi(value)
+		}
+	}
+
+	if contentLength == 0 {
+		return "", respHeaders, nil
+	}
+	buf := make([]byte, contentLength)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return "", nil, err
+	}
+	return string(buf), respHeaders, nil
+}
+
+// pumpInterleavedRTP reads RTSP's "$"-framed interleaved RTP/RTCP channels
+// off r and writes each RTP packet to the *webrtc.Track registered for its
+// channel number, until the connection errors out (typically EOF on
+// teardown, which bubbles back up to run's reconnect loop).
+func pumpInterleavedRTP(r *bufio.Reader, tracks map[int]*webrtc.Track) error {
+	for {
+		marker, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if marker != '$' {
+			continue
+		}
+
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		channel := int(header[0])
+		size := binary.BigEndian.Uint16(header[1:3])
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		// RTCP and odd/unregistered channels are discarded; only RTP data
+		// channels feed a track.
+		wt, ok := tracks[channel]
+		if !ok {
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(payload); err != nil {
+			log.Errorf("rtsp source: error unmarshalling rtp: %s", err)
+			continue
+		}
+		if err := wt.WriteRTP(pkt); err != nil {
+			log.Errorf("rtsp source: error writing rtp to track: %s", err)
+		}
+	}
+}
+
+// pumpRawRTP reads bare RTP datagrams off a UDP socket and writes each to
+// track, for the rtp:// scheme where there is no RTSP session at all.
+func pumpRawRTP(conn *net.UDPConn, track *webrtc.Track) error {
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(buf[:n]); err != nil {
+			log.Errorf("rtsp source: error unmarshalling rtp: %s", err)
+			continue
+		}
+		if err := track.WriteRTP(pkt); err != nil {
+			log.Errorf("rtsp source: error writing rtp to track: %s", err)
+		}
+	}
+}
+
+// newSSRC picks a random SSRC for a track minted from a non-SFU source,
+// where there is no remote SDP negotiation to source one from.
+func newSSRC() webrtc.SSRC {
+	return webrtc.SSRC(rand.Uint32())
+}
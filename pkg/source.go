@@ -0,0 +1,25 @@
+package avp
+
+import "errors"
+
+// ErrSourceSchemeNotSupported is returned when AVP.Process is given an addr
+// whose URL scheme doesn't match any known Source.
+var ErrSourceSchemeNotSupported = errors.New("source scheme not supported")
+
+// Source is implemented by anything AVP can pull media from for a session:
+// the existing ion-sfu gRPC client, or a standalone RTSPSource. It lets
+// AVP.Process stay agnostic to where a session's tracks actually come from.
+type Source interface {
+	// GetTransport returns (creating if necessary) the Transport carrying
+	// tracks for the given session id.
+	GetTransport(sid string) *Transport
+	// OnClose registers a callback invoked once the source is done for
+	// good and should be evicted from AVP.clients.
+	OnClose(f func())
+	stats() string
+}
+
+var (
+	_ Source = (*SFU)(nil)
+	_ Source = (*RTSPSource)(nil)
+)